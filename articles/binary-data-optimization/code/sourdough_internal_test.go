@@ -25,3 +25,23 @@ func TestCompactDateAndFlourType(t *testing.T) {
 
 	assert.Equal(t, data, back)
 }
+
+func TestCompactWeekAndFlourType(t *testing.T) {
+	//  year offset (8) | week (6) | day of week (3) | hour (5) | minute (6) | flour type (4)
+	data := []byte{
+		// [0] all year offset
+		0b0000_0000,
+		// [1] week (6) | day of week (2)
+		0b0100_1101,
+		// [2] day of week (1) | hour (5) | minute (2)
+		0b1010_0101,
+		// [3] minute (4) | flour type (4)
+		0b1110_0001,
+	}
+
+	sd := Data{}
+	decodeCompactWeekAndFlourType(data, &sd)
+	back := encodeCompactWeekAndFlourType(sd)
+
+	assert.Equal(t, data, back)
+}
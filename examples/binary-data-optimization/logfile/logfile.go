@@ -0,0 +1,326 @@
+// Package logfile stores sourdough.Data records in a single append-only file. Every
+// record has the same width for a given TimeMode, so random access is just a
+// Seek+Read once the byte offset of a record is known. A sparse sidecar index
+// (record N -> byte offset, written every indexInterval records) accelerates
+// time-range queries without needing an entry per record.
+package logfile
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"iter"
+	"os"
+	"sort"
+	"time"
+
+	"sourdough"
+)
+
+var magicBytes = [2]byte{'S', 'L'}
+
+const (
+	schemaVersion = 1
+	headerSize    = 14 // magic(2) + version(1) + TimeMode(1) + recordWidth(2) + start(8)
+
+	// indexInterval controls how many records are written between sidecar index
+	// entries. Smaller values mean faster range queries but a larger index.
+	indexInterval = 64
+)
+
+// File is an open sourdough log file and its sidecar index.
+type File struct {
+	path    string
+	idxPath string
+	f       *os.File
+
+	serializer sourdough.Serializer
+
+	// start is the physical record number of the first record that hasn't been
+	// truncated away. Records below start are still on disk until Compact runs.
+	start int64
+	count int64 // total physical records written, including truncated ones
+
+	index []indexEntry // sorted by record ascending
+}
+
+type indexEntry struct {
+	record int64
+	offset int64
+}
+
+// Open opens the log file at path, creating it (and its TimeMode header) if it
+// doesn't already exist.
+func Open(path string) (*File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("opening log file: %w", err)
+	}
+
+	lf := &File{path: path, idxPath: path + ".idx", f: f}
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("stat log file: %w", err)
+	}
+
+	size := info.Size()
+	if size == 0 {
+		lf.serializer = sourdough.DefaultSerializer
+		if err := lf.writeHeader(); err != nil {
+			return nil, err
+		}
+		size = headerSize
+	} else if err := lf.readHeader(); err != nil {
+		return nil, err
+	}
+
+	lf.count = (size - headerSize) / lf.serializer.DataSize
+	if err := lf.loadIndex(); err != nil {
+		return nil, err
+	}
+
+	return lf, nil
+}
+
+func (lf *File) writeHeader() error {
+	header := make([]byte, headerSize)
+	header[0], header[1] = magicBytes[0], magicBytes[1]
+	header[2] = schemaVersion
+	header[3] = byte(lf.serializer.TimeMode)
+	binary.LittleEndian.PutUint16(header[4:], uint16(lf.serializer.DataSize))
+	binary.LittleEndian.PutUint64(header[6:], uint64(lf.start))
+
+	_, err := lf.f.WriteAt(header, 0)
+	return err
+}
+
+func (lf *File) readHeader() error {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(io.NewSectionReader(lf.f, 0, headerSize), header); err != nil {
+		return fmt.Errorf("reading log file header: %w", err)
+	}
+
+	if header[0] != magicBytes[0] || header[1] != magicBytes[1] {
+		return fmt.Errorf("not a sourdough log file: bad magic bytes")
+	}
+	if header[2] != schemaVersion {
+		return fmt.Errorf("unsupported log file schema version: %d", header[2])
+	}
+
+	lf.serializer = sourdough.NewSerializer(sourdough.TimeMode(header[3]))
+	lf.start = int64(binary.LittleEndian.Uint64(header[6:]))
+	return nil
+}
+
+func (lf *File) offsetOf(record int64) int64 {
+	return headerSize + record*lf.serializer.DataSize
+}
+
+// Append writes a new record to the end of the log, indexing it if it lands on an
+// indexInterval boundary.
+func (lf *File) Append(sd sourdough.Data) error {
+	offset := lf.offsetOf(lf.count)
+	if _, err := lf.f.WriteAt(lf.serializer.Encode(sd), offset); err != nil {
+		return fmt.Errorf("appending record: %w", err)
+	}
+
+	if lf.count%indexInterval == 0 {
+		lf.index = append(lf.index, indexEntry{record: lf.count, offset: offset})
+		if err := lf.appendIndexEntry(lf.count, offset); err != nil {
+			return err
+		}
+	}
+
+	lf.count++
+	return nil
+}
+
+// At returns the i'th record that hasn't been truncated away.
+func (lf *File) At(i int) (sourdough.Data, error) {
+	record := lf.start + int64(i)
+	if record < lf.start || record >= lf.count {
+		return sourdough.Data{}, fmt.Errorf("index %d out of range", i)
+	}
+
+	return lf.readRecord(record)
+}
+
+func (lf *File) readRecord(record int64) (sourdough.Data, error) {
+	buf := make([]byte, lf.serializer.DataSize)
+	if _, err := lf.f.ReadAt(buf, lf.offsetOf(record)); err != nil {
+		return sourdough.Data{}, fmt.Errorf("reading record %d: %w", record, err)
+	}
+
+	var sd sourdough.Data
+	lf.serializer.Decode(buf, &sd)
+	return sd, nil
+}
+
+// seekToTime uses the sidecar index to binary search for the last indexed record
+// strictly before target (or the first live record if no indexed record is),
+// assuming records are appended in non-decreasing Time order.
+// Callers only need to linearly scan the indexInterval-sized window after the
+// result instead of the whole file.
+func (lf *File) seekToTime(target time.Time) (int64, error) {
+	validFrom := sort.Search(len(lf.index), func(i int) bool {
+		return lf.index[i].record >= lf.start
+	})
+	entries := lf.index[validFrom:]
+
+	var readErr error
+	i := sort.Search(len(entries), func(i int) bool {
+		sd, err := lf.readRecord(entries[i].record)
+		if err != nil {
+			readErr = err
+			return true
+		}
+		return !sd.Time.Before(target)
+	})
+	if readErr != nil {
+		return 0, readErr
+	}
+
+	if i == 0 {
+		return lf.start, nil
+	}
+	return entries[i-1].record, nil
+}
+
+// Range returns an iterator over every record with Time in [start, end), using the
+// sidecar index to skip directly to a record near the start of the range.
+func (lf *File) Range(start, end time.Time) iter.Seq[sourdough.Data] {
+	return func(yield func(sourdough.Data) bool) {
+		record, err := lf.seekToTime(start)
+		if err != nil {
+			return
+		}
+
+		for ; record < lf.count; record++ {
+			sd, err := lf.readRecord(record)
+			if err != nil {
+				return
+			}
+			if !sd.Time.Before(end) {
+				return
+			}
+			if sd.Time.Before(start) {
+				continue
+			}
+			if !yield(sd) {
+				return
+			}
+		}
+	}
+}
+
+// Truncate marks every record with Time before the given time as no longer
+// readable. It does not reclaim disk space; call Compact for that.
+func (lf *File) Truncate(before time.Time) error {
+	record := lf.start
+	for record < lf.count {
+		sd, err := lf.readRecord(record)
+		if err != nil {
+			return err
+		}
+		if !sd.Time.Before(before) {
+			break
+		}
+		record++
+	}
+
+	lf.start = record
+	return lf.writeHeader()
+}
+
+// Compact rewrites the log file to drop records truncated by Truncate, reclaiming
+// their disk space and rebuilding the sidecar index.
+func (lf *File) Compact() error {
+	tmpPath := lf.path + ".compact"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("creating compaction file: %w", err)
+	}
+
+	compacted := &File{path: tmpPath, idxPath: tmpPath + ".idx", f: tmp, serializer: lf.serializer}
+	if err := compacted.writeHeader(); err != nil {
+		return err
+	}
+
+	for record := lf.start; record < lf.count; record++ {
+		sd, err := lf.readRecord(record)
+		if err != nil {
+			return err
+		}
+		if err := compacted.Append(sd); err != nil {
+			return err
+		}
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("closing compaction file: %w", err)
+	}
+	if err := lf.f.Close(); err != nil {
+		return fmt.Errorf("closing log file: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, lf.path); err != nil {
+		return fmt.Errorf("replacing log file with compacted copy: %w", err)
+	}
+	if err := os.Rename(compacted.idxPath, lf.idxPath); err != nil {
+		return fmt.Errorf("replacing index file with compacted copy: %w", err)
+	}
+
+	replaced, err := Open(lf.path)
+	if err != nil {
+		return err
+	}
+	*lf = *replaced
+	return nil
+}
+
+func (lf *File) appendIndexEntry(record, offset int64) error {
+	idx, err := os.OpenFile(lf.idxPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("opening index file: %w", err)
+	}
+	defer idx.Close()
+
+	entry := make([]byte, 16)
+	binary.LittleEndian.PutUint64(entry, uint64(record))
+	binary.LittleEndian.PutUint64(entry[8:], uint64(offset))
+
+	_, err = idx.Write(entry)
+	return err
+}
+
+func (lf *File) loadIndex() error {
+	idx, err := os.Open(lf.idxPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("opening index file: %w", err)
+	}
+	defer idx.Close()
+
+	entry := make([]byte, 16)
+	for {
+		if _, err := io.ReadFull(idx, entry); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("reading index file: %w", err)
+		}
+
+		lf.index = append(lf.index, indexEntry{
+			record: int64(binary.LittleEndian.Uint64(entry)),
+			offset: int64(binary.LittleEndian.Uint64(entry[8:])),
+		})
+	}
+}
+
+// Close closes the underlying file.
+func (lf *File) Close() error {
+	return lf.f.Close()
+}
@@ -0,0 +1,89 @@
+package logfile_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"sourdough"
+	"sourdough/logfile"
+)
+
+func testData(n int) []sourdough.Data {
+	data := make([]sourdough.Data, n)
+	for i := range data {
+		data[i] = sourdough.Data{
+			Time:         time.Date(2025, 1, 1, 0, i, 0, 0, time.UTC),
+			StarterGrams: uint8(i % 256),
+			FlourGrams:   100,
+			WaterGrams:   80,
+			FlourType:    sourdough.FlourTypeBread,
+		}
+	}
+	return data
+}
+
+func TestAppendAndAt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.sdl")
+
+	f, err := logfile.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	data := testData(200)
+	for _, sd := range data {
+		require.NoError(t, f.Append(sd))
+	}
+
+	for i, expected := range data {
+		actual, err := f.At(i)
+		require.NoError(t, err)
+		assert.Equal(t, expected, actual)
+	}
+}
+
+func TestRange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.sdl")
+
+	f, err := logfile.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	data := testData(200)
+	for _, sd := range data {
+		require.NoError(t, f.Append(sd))
+	}
+
+	start := data[50].Time
+	end := data[150].Time
+
+	var actual []sourdough.Data
+	for sd := range f.Range(start, end) {
+		actual = append(actual, sd)
+	}
+
+	assert.Equal(t, data[50:150], actual)
+}
+
+func TestTruncateAndCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.sdl")
+
+	f, err := logfile.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	data := testData(200)
+	for _, sd := range data {
+		require.NoError(t, f.Append(sd))
+	}
+
+	require.NoError(t, f.Truncate(data[100].Time))
+	require.NoError(t, f.Compact())
+
+	actual, err := f.At(0)
+	require.NoError(t, err)
+	assert.Equal(t, data[100], actual)
+}
@@ -11,6 +11,7 @@ const (
 	TimeModeUnix TimeMode = iota
 	TimeModeUnixMinute
 	TimeModeCompact
+	TimeModeCompactWeek
 )
 
 type Serializer struct {
@@ -23,6 +24,8 @@ func NewSerializer(timeMode TimeMode) Serializer {
 	switch timeMode {
 	case TimeModeCompact:
 		dataSize = 7
+	case TimeModeCompactWeek:
+		dataSize = 7
 	case TimeModeUnix:
 		dataSize = 12
 	case TimeModeUnixMinute:
@@ -33,7 +36,7 @@ func NewSerializer(timeMode TimeMode) Serializer {
 }
 
 func (s Serializer) Encode(sd Data) []byte {
-	buf := make([]byte, DefaultSerializer.DataSize)
+	buf := make([]byte, s.DataSize)
 
 	buf[0] = sd.StarterGrams
 	buf[1] = sd.FlourGrams
@@ -42,6 +45,8 @@ func (s Serializer) Encode(sd Data) []byte {
 	switch s.TimeMode {
 	case TimeModeCompact:
 		copy(buf[3:], encodeCompactDateAndFlourType(sd))
+	case TimeModeCompactWeek:
+		copy(buf[3:], encodeCompactWeekAndFlourType(sd))
 	case TimeModeUnix:
 		buf[3] = byte(sd.FlourType)
 		binary.LittleEndian.PutUint64(buf[4:], uint64(sd.Time.Unix()))
@@ -61,6 +66,8 @@ func (s Serializer) Decode(in []byte, sd *Data) {
 	switch s.TimeMode {
 	case TimeModeCompact:
 		decodeCompactDateAndFlourType(in[3:], sd)
+	case TimeModeCompactWeek:
+		decodeCompactWeekAndFlourType(in[3:], sd)
 	case TimeModeUnix:
 		sd.FlourType = FlourType(in[3])
 		unixTime := binary.LittleEndian.Uint64(in[4:])
@@ -122,3 +129,75 @@ func decodeCompactDateAndFlourType(data []byte, sd *Data) {
 	sd.Time = time.Date(year, time.Month(month), int(day), int(hour), int(minute), 0, 0, time.UTC)
 	sd.FlourType = FlourType(data[3] & 0b0000_1111)
 }
+
+// year offset (8) | week (6) | day of week (3) | hour (5) | minute (6) | flour type (4)
+//
+// The year offset is the ISO week-numbering year, not the calendar year: the ISO
+// year at the very end of December or the start of January can differ from the
+// calendar year, so encoding the calendar year here would not round-trip through
+// time.Date back to the original instant.
+func encodeCompactWeekAndFlourType(sd Data) []byte {
+	isoYear, isoWeek := sd.Time.ISOWeek()
+
+	// Year offset is one byte/uint8, same as the date-based compact mode.
+	year := uint8(isoYear - 2025)
+
+	// Week is the left six bits of the 2nd byte.
+	week := uint8(isoWeek) << 2
+
+	// Day of week is 3 bits split across the 2nd and 3rd bytes. ISO weekday is
+	// Monday=1..Sunday=7, unlike time.Weekday's Sunday=0..Saturday=6.
+	dayOfWeek := uint8(sd.Time.Weekday())
+	if dayOfWeek == 0 {
+		dayOfWeek = 7
+	}
+	dayPart1 := (dayOfWeek & 0b110) >> 1
+	dayPart2 := (dayOfWeek & 0b001) << 7
+
+	// Hour is 5 bits in the middle of the 3rd byte.
+	hour := uint8(sd.Time.Hour()) << 2
+
+	// Minute is 6 bits split across the 3rd and 4th bytes.
+	minute := uint8(sd.Time.Minute())
+	minutePart1 := (minute & 0b11_0000) >> 4
+	minutePart2 := (minute & 0b00_1111) << 4
+
+	// FlourType is just the final 4 bits.
+	flourType := uint8(sd.FlourType) & 0b0000_1111
+
+	return []byte{
+		year,
+		week | dayPart1,
+		dayPart2 | hour | minutePart1,
+		minutePart2 | flourType,
+	}
+}
+
+func decodeCompactWeekAndFlourType(data []byte, sd *Data) {
+	isoYear := int(data[0]) + 2025
+
+	week := int(data[1] >> 2)
+
+	dayPart1 := (data[1] << 1) & 0b110
+	dayPart2 := (data[2] >> 7) & 0b001
+	dayOfWeek := int(dayPart1 | dayPart2)
+
+	hour := (data[2] >> 2) & 0b000_11111
+
+	minutePart1 := (data[2] << 4) & 0b11_0000
+	minutePart2 := (data[3] >> 4) & 0b00_1111
+	minute := int(minutePart1 | minutePart2)
+
+	// Reconstruct the Monday of ISO week 1 in isoYear, then walk forward to the
+	// encoded week and weekday.
+	jan4 := time.Date(isoYear, time.January, 4, 0, 0, 0, 0, time.UTC)
+	jan4Weekday := int(jan4.Weekday())
+	if jan4Weekday == 0 {
+		jan4Weekday = 7
+	}
+	mondayWeek1 := jan4.AddDate(0, 0, -(jan4Weekday - 1))
+	date := mondayWeek1.AddDate(0, 0, (week-1)*7+(dayOfWeek-1))
+
+	sd.Time = time.Date(date.Year(), date.Month(), date.Day(), int(hour), minute, 0, 0, time.UTC)
+	sd.FlourType = FlourType(data[3] & 0b0000_1111)
+}
@@ -114,6 +114,52 @@ func BenchmarkBinaryCompact(b *testing.B) {
 	copy(cp, outBytes)
 }
 
+func BenchmarkStreamCompact(b *testing.B) {
+	sourdough.DefaultSerializer = sourdough.NewSerializer(sourdough.TimeModeCompact)
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		var out bytes.Buffer
+		enc := sourdough.NewEncoder(&out)
+		for _, sd := range data {
+			_ = enc.Encode(sd)
+		}
+
+		dec := sourdough.NewDecoder(&out)
+		sd := make([]sourdough.Data, 0, len(data))
+		for d, err := range dec.Iter() {
+			if err != nil {
+				b.Fatal(err)
+			}
+			sd = append(sd, d)
+		}
+
+		assert.ElementsMatch(b, data, sd)
+	}
+}
+
+func TestEncodeUsesInstanceDataSize(t *testing.T) {
+	// DefaultSerializer deliberately differs from the Serializer under test, so
+	// Encode can't get away with sizing its buffer off the package global.
+	sourdough.DefaultSerializer = sourdough.NewSerializer(sourdough.TimeModeCompact)
+
+	s := sourdough.NewSerializer(sourdough.TimeModeUnix)
+	sd := sourdough.Data{
+		Time:         time.Date(2026, time.January, 2, 3, 4, 0, 0, time.UTC),
+		StarterGrams: 10,
+		FlourGrams:   100,
+		WaterGrams:   80,
+		FlourType:    sourdough.FlourTypeBread,
+	}
+
+	encoded := s.Encode(sd)
+	assert.Len(t, encoded, 12)
+
+	var decoded sourdough.Data
+	s.Decode(encoded, &decoded)
+	assert.Equal(t, sd, decoded)
+}
+
 func TestManyIterations(t *testing.T) {
 	t.Skip()
 	n := 1000
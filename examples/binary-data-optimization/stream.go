@@ -0,0 +1,130 @@
+package sourdough
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+)
+
+// magicBytes identifies a sourdough stream so a Decoder can fail fast on garbage
+// input instead of misinterpreting the header that follows it.
+var magicBytes = [2]byte{'S', 'D'}
+
+const streamVersion = 1
+
+// Encoder writes Data records one at a time using the same fixed-width layout as
+// Serializer.Encode, so a caller with tens of millions of records doesn't need to
+// hold them all in memory before encoding.
+type Encoder struct {
+	w           io.Writer
+	serializer  Serializer
+	wroteHeader bool
+}
+
+// NewEncoder creates an Encoder that writes records using DefaultSerializer's
+// TimeMode. The mode is recorded in a header so a Decoder reading the stream back
+// can self-configure instead of relying on DefaultSerializer being unchanged.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w, serializer: DefaultSerializer}
+}
+
+func (e *Encoder) writeHeader() error {
+	_, err := e.w.Write([]byte{magicBytes[0], magicBytes[1], streamVersion, byte(e.serializer.TimeMode)})
+	return err
+}
+
+// Encode writes a single Data record to the stream, writing the header first if
+// this is the first call.
+func (e *Encoder) Encode(sd Data) error {
+	if !e.wroteHeader {
+		if err := e.writeHeader(); err != nil {
+			return fmt.Errorf("writing stream header: %w", err)
+		}
+		e.wroteHeader = true
+	}
+
+	_, err := e.w.Write(e.serializer.Encode(sd))
+	return err
+}
+
+// EncodeAll writes every Data in seq to the stream, stopping at the first error.
+func (e *Encoder) EncodeAll(seq iter.Seq[Data]) error {
+	for sd := range seq {
+		if err := e.Encode(sd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Decoder reads Data records written by an Encoder, self-configuring its TimeMode
+// from the stream's header the first time a record is read.
+type Decoder struct {
+	r          io.Reader
+	serializer Serializer
+	readHeader bool
+}
+
+// NewDecoder creates a Decoder. The header is read lazily on the first call to
+// Decode or Iter.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: r}
+}
+
+func (d *Decoder) readHeaderOnce() error {
+	if d.readHeader {
+		return nil
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(d.r, header); err != nil {
+		return fmt.Errorf("reading stream header: %w", err)
+	}
+
+	if header[0] != magicBytes[0] || header[1] != magicBytes[1] {
+		return fmt.Errorf("not a sourdough stream: bad magic bytes")
+	}
+	if header[2] != streamVersion {
+		return fmt.Errorf("unsupported stream version: %d", header[2])
+	}
+
+	d.serializer = NewSerializer(TimeMode(header[3]))
+	d.readHeader = true
+	return nil
+}
+
+// Decode reads a single Data record from the stream.
+func (d *Decoder) Decode() (Data, error) {
+	if err := d.readHeaderOnce(); err != nil {
+		return Data{}, err
+	}
+
+	buf := make([]byte, d.serializer.DataSize)
+	if _, err := io.ReadFull(d.r, buf); err != nil {
+		return Data{}, err
+	}
+
+	var sd Data
+	d.serializer.Decode(buf, &sd)
+	return sd, nil
+}
+
+// Iter returns an iterator over every Data record in the stream. It yields a single
+// error and stops if reading or decoding fails before the stream is exhausted.
+func (d *Decoder) Iter() iter.Seq2[Data, error] {
+	return func(yield func(Data, error) bool) {
+		for {
+			sd, err := d.Decode()
+			if err != nil {
+				if !errors.Is(err, io.EOF) {
+					yield(Data{}, err)
+				}
+				return
+			}
+			if !yield(sd, nil) {
+				return
+			}
+		}
+	}
+}
@@ -1,44 +1,169 @@
 package shortener
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"math"
+	"math/rand"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 )
 
-var DefaultClient = http.DefaultClient
+const defaultEndpoint = "https://cleanuri.com/api/v1/shorten"
 
-const address = "https://cleanuri.com/api/v1/shorten"
+// RetryPolicy controls how a Shortener retries a request that the server
+// rate-limited with a 429 response.
+type RetryPolicy struct {
+	MaxAttempts int
+	Base        time.Duration
+	Cap         time.Duration
+	Jitter      float64 // fraction of each backoff, in [0, 1], that is randomized
+}
+
+// DefaultRetryPolicy is a truncated exponential backoff capped at 30s, with jitter
+// so that callers retrying in lockstep don't all hammer the server at once.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	Base:        250 * time.Millisecond,
+	Cap:         30 * time.Second,
+	Jitter:      0.5,
+}
+
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := float64(p.Base) * math.Pow(2, float64(attempt))
+	if cap := float64(p.Cap); d > cap {
+		d = cap
+	}
+	if p.Jitter > 0 {
+		d = d*(1-p.Jitter) + rand.Float64()*p.Jitter*d
+	}
+	return time.Duration(d)
+}
+
+// Shortener shortens URLs using the cleanuri.com API, retrying rate-limited requests
+// according to Policy.
+type Shortener struct {
+	Client   *http.Client
+	Policy   RetryPolicy
+	Endpoint string
+}
+
+// DefaultShortener is used by the package-level Shorten function.
+var DefaultShortener = &Shortener{
+	Client:   http.DefaultClient,
+	Policy:   DefaultRetryPolicy,
+	Endpoint: defaultEndpoint,
+}
 
-// Shorten will returned the shortened URL
+// Shorten shortens targetURL using DefaultShortener.
 func Shorten(targetURL string) (string, error) {
-	resp, err := DefaultClient.PostForm(
-		address,
-		url.Values{"url": []string{targetURL}},
-	)
+	return DefaultShortener.Shorten(context.Background(), targetURL)
+}
+
+// Shorten returns the shortened URL, retrying according to s.Policy when the server
+// responds with 429 Too Many Requests. ctx governs the whole call, including any
+// time spent waiting out a retry.
+func (s *Shortener) Shorten(ctx context.Context, targetURL string) (string, error) {
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	endpoint := s.Endpoint
+	if endpoint == "" {
+		endpoint = defaultEndpoint
+	}
+	policy := s.Policy
+	if policy.MaxAttempts == 0 {
+		policy = DefaultRetryPolicy
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < policy.MaxAttempts; attempt++ {
+		result, wait, err := s.attempt(ctx, client, endpoint, targetURL)
+		if err != nil {
+			return "", err
+		}
+		if wait == 0 {
+			return result, nil
+		}
+
+		lastErr = fmt.Errorf("rate limited on attempt %d", attempt+1)
+		if attempt == policy.MaxAttempts-1 {
+			break
+		}
+		if wait < 0 {
+			wait = policy.backoff(attempt)
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+
+	return "", fmt.Errorf("giving up after %d attempts: %w", policy.MaxAttempts, lastErr)
+}
+
+// attempt performs a single request. A positive wait means the caller was rate
+// limited and should sleep for that long before retrying; -1 means rate limited
+// with no usable Retry-After, so the caller should fall back to its own backoff.
+func (s *Shortener) attempt(ctx context.Context, client *http.Client, endpoint, targetURL string) (result string, wait time.Duration, err error) {
+	body := strings.NewReader(url.Values{"url": []string{targetURL}}.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, body)
 	if err != nil {
-		return "", err
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", 0, err
 	}
 	defer resp.Body.Close()
 
 	switch resp.StatusCode {
 	case http.StatusOK:
+		var respData struct {
+			ResultURL string `json:"result_url"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&respData); err != nil {
+			return "", 0, err
+		}
+		return respData.ResultURL, 0, nil
 	case http.StatusTooManyRequests:
-		time.Sleep(time.Second)
-		return Shorten(targetURL)
+		if d := retryAfter(resp.Header.Get("Retry-After")); d > 0 {
+			return "", d, nil
+		}
+		return "", -1, nil
 	default:
-		return "", fmt.Errorf("unexpected response code: %d", resp.StatusCode)
+		return "", 0, fmt.Errorf("unexpected response code: %d", resp.StatusCode)
 	}
+}
 
-	var respData struct {
-		ResultURL string `json:"result_url"`
+// retryAfter parses a Retry-After header in either its delta-seconds or HTTP-date
+// form, returning 0 if the header is absent, malformed, or already in the past.
+func retryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
 	}
-	err = json.NewDecoder(resp.Body).Decode(&respData)
-	if err != nil {
-		return "", err
+
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds <= 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+
+	if t, err := http.ParseTime(header); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
 	}
 
-	return respData.ResultURL, nil
+	return 0
 }
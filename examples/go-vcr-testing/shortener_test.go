@@ -1,6 +1,7 @@
 package shortener_test
 
 import (
+	"context"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -9,26 +10,35 @@ import (
 	shortener "go-vcr-testing-example"
 )
 
+func newRecordedShortener(t *testing.T, fixture string) *shortener.Shortener {
+	t.Helper()
+
+	r, err := recorder.New(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		require.NoError(t, r.Stop())
+	})
+
+	if r.Mode() != recorder.ModeRecordOnce {
+		t.Fatal("Recorder should be in ModeRecordOnce")
+	}
+
+	return &shortener.Shortener{
+		Client: r.GetDefaultClient(),
+		Policy: shortener.DefaultRetryPolicy,
+	}
+}
+
 func TestShorten(t *testing.T) {
 	fixtures := []string{"fixtures/dev.to", "fixtures/rate_limit"}
 
 	for _, fixture := range fixtures {
 		t.Run(fixture, func(t *testing.T) {
-			r, err := recorder.New(fixture)
-			if err != nil {
-				t.Fatal(err)
-			}
-			defer func() {
-				require.NoError(t, r.Stop())
-			}()
-
-			if r.Mode() != recorder.ModeRecordOnce {
-				t.Fatal("Recorder should be in ModeRecordOnce")
-			}
+			s := newRecordedShortener(t, fixture)
 
-			shortener.DefaultClient = r.GetDefaultClient()
-
-			shortened, err := shortener.Shorten("https://dev.to/calvinmclean")
+			shortened, err := s.Shorten(context.Background(), "https://dev.to/calvinmclean")
 			if err != nil {
 				t.Errorf("unexpected error: %v", err)
 			}
@@ -69,21 +79,9 @@ func TestShortenTable(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			r, err := recorder.New("fixtures/" + tt.name)
-			if err != nil {
-				t.Fatal(err)
-			}
-			defer func() {
-				require.NoError(t, r.Stop())
-			}()
-
-			if r.Mode() != recorder.ModeRecordOnce {
-				t.Fatal("Recorder should be in ModeRecordOnce")
-			}
-
-			shortener.DefaultClient = r.GetDefaultClient()
+			s := newRecordedShortener(t, "fixtures/"+tt.name)
 
-			shortened, err := shortener.Shorten(tt.url)
+			shortened, err := s.Shorten(context.Background(), tt.url)
 			if tt.expectedErr == "" {
 				if err != nil {
 					t.Errorf("unexpected error: %v", err)
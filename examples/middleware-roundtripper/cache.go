@@ -0,0 +1,670 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Storage is the cache backend CacheMiddleware and CacheRoundTripper store entries
+// in. MapStorage is the in-memory default; an LRU or disk-backed cache needs only
+// to implement Get/Set/Delete with this same key shape to drop in as a replacement.
+type Storage interface {
+	Get(key string) (*CacheEntry, bool)
+	Set(key string, entry *CacheEntry)
+	Delete(key string)
+}
+
+// MapStorage is a Storage backed by an in-memory map, with no eviction.
+type MapStorage struct {
+	mu      sync.Mutex
+	entries map[string]*CacheEntry
+}
+
+// NewMapStorage creates an empty MapStorage.
+func NewMapStorage() *MapStorage {
+	return &MapStorage{entries: map[string]*CacheEntry{}}
+}
+
+func (m *MapStorage) Get(key string) (*CacheEntry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.entries[key]
+	return entry, ok
+}
+
+func (m *MapStorage) Set(key string, entry *CacheEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.entries[key] = entry
+}
+
+func (m *MapStorage) Delete(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.entries, key)
+}
+
+// CacheEntry is a stored response, along with enough bookkeeping to compute its
+// freshness and to tell which requests it's allowed to be served to.
+type CacheEntry struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+
+	StoredAt   time.Time
+	InitialAge time.Duration // the response's own Age header, if any, at the time it was stored
+
+	// RequestVary holds, for each header named in this entry's Vary response
+	// header, the value that header had on the request that produced the entry.
+	RequestVary http.Header
+}
+
+func newCacheEntry(statusCode int, header http.Header, body []byte, reqHeader http.Header) *CacheEntry {
+	entry := &CacheEntry{
+		StatusCode: statusCode,
+		Header:     header.Clone(),
+		Body:       body,
+		StoredAt:   time.Now(),
+	}
+
+	if age, err := strconv.Atoi(header.Get("Age")); err == nil && age > 0 {
+		entry.InitialAge = time.Duration(age) * time.Second
+	}
+
+	if fields := entry.varyFields(); len(fields) > 0 {
+		entry.RequestVary = http.Header{}
+		for _, field := range fields {
+			entry.RequestVary.Set(field, reqHeader.Get(field))
+		}
+	}
+
+	return entry
+}
+
+func (e *CacheEntry) varyFields() []string {
+	vary := e.Header.Get("Vary")
+	if vary == "" {
+		return nil
+	}
+
+	fields := strings.Split(vary, ",")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	return fields
+}
+
+// matchesVary reports whether r is a request this entry may be served to, given
+// the header values captured from the request that originally produced it.
+func (e *CacheEntry) matchesVary(r *http.Request) bool {
+	for field, values := range e.RequestVary {
+		if len(values) == 0 {
+			continue
+		}
+		if r.Header.Get(field) != values[0] {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *CacheEntry) age(now time.Time) time.Duration {
+	return e.InitialAge + now.Sub(e.StoredAt)
+}
+
+func (e *CacheEntry) freshnessLifetime() time.Duration {
+	cc := parseCacheControl(e.Header.Get("Cache-Control"))
+	if cc.hasSMaxAge {
+		return cc.sMaxAge
+	}
+	if cc.hasMaxAge {
+		return cc.maxAge
+	}
+
+	expires := e.Header.Get("Expires")
+	if expires == "" {
+		return 0
+	}
+	expiresAt, err := http.ParseTime(expires)
+	if err != nil {
+		return 0
+	}
+
+	if date, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		return expiresAt.Sub(date)
+	}
+	return time.Until(expiresAt)
+}
+
+func (e *CacheEntry) isFresh(now time.Time) bool {
+	cc := parseCacheControl(e.Header.Get("Cache-Control"))
+	if cc.noCache || cc.noStore {
+		return false
+	}
+	return e.age(now) < e.freshnessLifetime()
+}
+
+// staleness is how far past its freshness lifetime the entry is; negative
+// while still fresh.
+func (e *CacheEntry) staleness(now time.Time) time.Duration {
+	return e.age(now) - e.freshnessLifetime()
+}
+
+// withinStaleWhileRevalidate reports whether a stale entry is still within its
+// RFC 5861 stale-while-revalidate window, in which it may be served immediately
+// while a background revalidation brings it up to date.
+func (e *CacheEntry) withinStaleWhileRevalidate(now time.Time) bool {
+	cc := parseCacheControl(e.Header.Get("Cache-Control"))
+	if !cc.hasStaleWhileRevalidate || cc.mustRevalidate {
+		return false
+	}
+	stale := e.staleness(now)
+	return stale >= 0 && stale < cc.staleWhileRevalidate
+}
+
+// withinStaleIfError reports whether a stale entry is still within its RFC
+// 5861 stale-if-error window, in which it may stand in for an upstream error.
+// must-revalidate takes precedence over stale-if-error per RFC 5861 §4: an
+// entry that demands revalidation may never stand in for an error response.
+func (e *CacheEntry) withinStaleIfError(now time.Time) bool {
+	cc := parseCacheControl(e.Header.Get("Cache-Control"))
+	if !cc.hasStaleIfError || cc.mustRevalidate {
+		return false
+	}
+	stale := e.staleness(now)
+	return stale >= 0 && stale < cc.staleIfError
+}
+
+// writeTo writes the entry to w as a server response, optionally marking it as
+// server-cached.
+func (e *CacheEntry) writeTo(w http.ResponseWriter, fromCache bool) {
+	for key, values := range e.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	if fromCache {
+		w.Header().Set("X-Server-Cached", "true")
+	}
+	w.WriteHeader(e.StatusCode)
+	w.Write(e.Body)
+}
+
+// writeNotModified writes a bare 304 response carrying only the entry's
+// validators, for a conditional request that already has the current
+// representation.
+func (e *CacheEntry) writeNotModified(w http.ResponseWriter) {
+	if etag := e.Header.Get("ETag"); etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if lastModified := e.Header.Get("Last-Modified"); lastModified != "" {
+		w.Header().Set("Last-Modified", lastModified)
+	}
+	w.Header().Set("X-Server-Cached", "true")
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// etagMatches reports whether r's conditional headers already match e's stored
+// validator, per the basic RFC 7232 comparison: an exact If-None-Match, or an
+// unchanged If-Modified-Since.
+func (e *CacheEntry) etagMatches(r *http.Request) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := e.Header.Get("ETag")
+		return etag != "" && inm == etag
+	}
+
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		lastModified := e.Header.Get("Last-Modified")
+		if lastModified == "" {
+			return false
+		}
+		imsTime, err1 := http.ParseTime(ims)
+		lmTime, err2 := http.ParseTime(lastModified)
+		return err1 == nil && err2 == nil && !lmTime.After(imsTime)
+	}
+
+	return false
+}
+
+// response builds an *http.Response from the entry, for use by CacheRoundTripper.
+func (e *CacheEntry) response(fromCache bool) *http.Response {
+	header := e.Header.Clone()
+	if fromCache {
+		header.Set("X-Client-Cached", "true")
+	}
+
+	return &http.Response{
+		StatusCode:    e.StatusCode,
+		Status:        http.StatusText(e.StatusCode),
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(e.Body)),
+		ContentLength: int64(len(e.Body)),
+	}
+}
+
+// cacheControl is the subset of Cache-Control directives CacheMiddleware and
+// CacheRoundTripper understand, on either a request or a response.
+type cacheControl struct {
+	noStore        bool
+	noCache        bool
+	private        bool
+	mustRevalidate bool
+
+	maxAge    time.Duration
+	hasMaxAge bool
+
+	sMaxAge    time.Duration
+	hasSMaxAge bool
+
+	staleWhileRevalidate    time.Duration
+	hasStaleWhileRevalidate bool
+
+	staleIfError    time.Duration
+	hasStaleIfError bool
+}
+
+func parseCacheControl(header string) cacheControl {
+	var cc cacheControl
+
+	for _, directive := range strings.Split(header, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+
+		switch name {
+		case "no-store":
+			cc.noStore = true
+		case "no-cache":
+			cc.noCache = true
+		case "private":
+			cc.private = true
+		case "must-revalidate":
+			cc.mustRevalidate = true
+		case "max-age":
+			if seconds, err := strconv.Atoi(value); err == nil {
+				cc.maxAge = time.Duration(seconds) * time.Second
+				cc.hasMaxAge = true
+			}
+		case "s-maxage":
+			if seconds, err := strconv.Atoi(value); err == nil {
+				cc.sMaxAge = time.Duration(seconds) * time.Second
+				cc.hasSMaxAge = true
+			}
+		case "stale-while-revalidate":
+			if seconds, err := strconv.Atoi(value); err == nil {
+				cc.staleWhileRevalidate = time.Duration(seconds) * time.Second
+				cc.hasStaleWhileRevalidate = true
+			}
+		case "stale-if-error":
+			if seconds, err := strconv.Atoi(value); err == nil {
+				cc.staleIfError = time.Duration(seconds) * time.Second
+				cc.hasStaleIfError = true
+			}
+		}
+	}
+
+	return cc
+}
+
+// CacheOptions configures which requests CacheMiddleware and CacheRoundTripper
+// cache and how they're keyed. The zero value matches the original behavior: only
+// GET is cacheable, keyed on method and URL.
+type CacheOptions struct {
+	// CacheKey computes the Storage key for a request. Defaults to method+URL.
+	CacheKey func(*http.Request) string
+	// CacheableMethods lists additional HTTP methods, beyond GET, that may be
+	// cached — e.g. POST for a search endpoint whose body fully determines the
+	// response, or WebDAV's PROPFIND/REPORT.
+	CacheableMethods []string
+	// EnableETagPair makes CacheMiddleware synthesize an ETag/Last-Modified pair
+	// from the response body when the handler doesn't set its own, and answer a
+	// matching If-None-Match/If-Modified-Since with a bare 304 without invoking
+	// the handler at all while the stored entry is still fresh. A stale entry is
+	// revalidated with the handler as usual.
+	EnableETagPair bool
+}
+
+// cacheKey identifies a cacheable request before Vary is taken into account; entry
+// lookups additionally check CacheEntry.matchesVary.
+func (o CacheOptions) cacheKey(r *http.Request) string {
+	if o.CacheKey != nil {
+		return o.CacheKey(r)
+	}
+	return r.Method + " " + r.URL.String()
+}
+
+func (o CacheOptions) cacheable(method string) bool {
+	return method == http.MethodGet || slices.Contains(o.CacheableMethods, method)
+}
+
+// HashBodyCacheKey is a CacheKey that folds a hash of the request body into the
+// method+URL key, so requests like a POST search endpoint get distinct cache
+// entries per payload instead of colliding on method+URL alone. It reads and
+// restores r.Body so the request can still be sent normally.
+func HashBodyCacheKey(r *http.Request) string {
+	base := r.Method + " " + r.URL.String()
+	if r.Body == nil || r.Body == http.NoBody {
+		return base
+	}
+
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return base
+	}
+
+	sum := sha256.Sum256(body)
+	return base + "#" + hex.EncodeToString(sum[:])
+}
+
+// addConditionalHeaders copies validators from a stale entry onto an outgoing
+// request so the origin can answer with a cheap 304 instead of the full body.
+func addConditionalHeaders(r *http.Request, entry *CacheEntry) {
+	if etag := entry.Header.Get("ETag"); etag != "" {
+		r.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := entry.Header.Get("Last-Modified"); lastModified != "" {
+		r.Header.Set("If-Modified-Since", lastModified)
+	}
+}
+
+// refreshEntry returns a copy of entry as of now, with any headers present on a
+// 304 response merged in, per RFC 7234's handling of a successful revalidation.
+func refreshEntry(entry *CacheEntry, responseHeader http.Header) *CacheEntry {
+	refreshed := *entry
+	refreshed.Header = entry.Header.Clone()
+	refreshed.StoredAt = time.Now()
+	refreshed.InitialAge = 0
+
+	for key, values := range responseHeader {
+		if len(values) > 0 {
+			refreshed.Header[key] = values
+		}
+	}
+
+	if age, err := strconv.Atoi(responseHeader.Get("Age")); err == nil && age > 0 {
+		refreshed.InitialAge = time.Duration(age) * time.Second
+	}
+
+	return &refreshed
+}
+
+// revalidateHandlerInBackground refreshes a stale entry by calling next again
+// with a detached request (so the original caller's response isn't held open
+// waiting on it), storing whatever comes back. sf dedups concurrent stale hits
+// on the same key down to a single revalidation.
+func revalidateHandlerInBackground(sf *singleflight.Group, key string, r *http.Request, reqHeader http.Header, opts CacheOptions, storage Storage, next http.HandlerFunc) {
+	sf.DoChan(key, func() (any, error) {
+		revalReq := r.Clone(context.Background())
+		revalReq.Header = reqHeader.Clone()
+		revalReq.Body = http.NoBody
+
+		buffered := newBufferingResponseWriter()
+		next(buffered, revalReq)
+
+		respCC := parseCacheControl(buffered.header.Get("Cache-Control"))
+		if buffered.statusCode == http.StatusOK && !respCC.noStore && !respCC.private {
+			body := buffered.buffer.Bytes()
+			if opts.EnableETagPair {
+				synthesizeValidator(buffered.header, body)
+			}
+			storage.Set(key, newCacheEntry(buffered.statusCode, buffered.header, body, reqHeader))
+		}
+		return nil, nil
+	})
+}
+
+// revalidateUpstreamInBackground is CacheRoundTripper's counterpart: it
+// reissues r against next and stores a fresh entry if the upstream succeeds.
+// A failed revalidation just leaves the stale entry in place to try again
+// next time.
+func revalidateUpstreamInBackground(sf *singleflight.Group, key string, r *http.Request, next http.RoundTripper, storage Storage) {
+	sf.DoChan(key, func() (any, error) {
+		revalReq := r.Clone(context.Background())
+		reqHeader := revalReq.Header.Clone()
+
+		resp, err := next.RoundTrip(revalReq)
+		if err != nil {
+			return nil, nil
+		}
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, nil
+		}
+
+		respCC := parseCacheControl(resp.Header.Get("Cache-Control"))
+		if resp.StatusCode == http.StatusOK && !respCC.noStore && !respCC.private {
+			storage.Set(key, newCacheEntry(resp.StatusCode, resp.Header, body, reqHeader))
+		}
+		return nil, nil
+	})
+}
+
+// synthesizeValidator sets an ETag and Last-Modified on header from a hash of
+// body, if the response doesn't already carry a validator of its own. This is
+// what lets EnableETagPair support conditional requests against handlers that
+// never set ETag/Last-Modified themselves.
+func synthesizeValidator(header http.Header, body []byte) {
+	if header.Get("ETag") != "" || header.Get("Last-Modified") != "" {
+		return
+	}
+	sum := sha256.Sum256(body)
+	header.Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	header.Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+}
+
+// bufferingResponseWriter collects a response fully in memory instead of
+// streaming it through to the real http.ResponseWriter as it's written. This
+// is what lets EnableETagPair add a validator computed from the whole body
+// before anything is sent to the client.
+type bufferingResponseWriter struct {
+	header     http.Header
+	buffer     bytes.Buffer
+	statusCode int
+}
+
+func newBufferingResponseWriter() *bufferingResponseWriter {
+	return &bufferingResponseWriter{header: http.Header{}, statusCode: http.StatusOK}
+}
+
+func (w *bufferingResponseWriter) Header() http.Header         { return w.header }
+func (w *bufferingResponseWriter) Write(b []byte) (int, error) { return w.buffer.Write(b) }
+func (w *bufferingResponseWriter) WriteHeader(code int)        { w.statusCode = code }
+
+// CacheMiddleware honors HTTP caching semantics for GET requests: it computes
+// freshness from Cache-Control/Expires, revalidates stale entries with
+// If-None-Match/If-Modified-Since, and keys entries against the response's Vary
+// header so a response that varies on, say, Authorization is never served to a
+// caller who didn't present the same value.
+func CacheMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return NewCacheMiddleware(NewMapStorage(), CacheOptions{})(next)
+}
+
+// NewCacheMiddleware builds a CacheMiddleware backed by a custom Storage, e.g. an
+// LRU or disk-backed cache instead of the default in-memory map, and configured by
+// opts (which methods are cacheable, and how they're keyed).
+func NewCacheMiddleware(storage Storage, opts CacheOptions) func(http.HandlerFunc) http.HandlerFunc {
+	var sf singleflight.Group
+
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if !opts.cacheable(r.Method) {
+				next(w, r)
+				return
+			}
+
+			reqCC := parseCacheControl(r.Header.Get("Cache-Control"))
+			if reqCC.noStore {
+				// A request's own no-store means the cache must play no part at
+				// all: neither serve a stored response nor store this one.
+				next(w, r)
+				return
+			}
+
+			reqHeader := r.Header.Clone()
+			key := opts.cacheKey(r)
+
+			entry, ok := storage.Get(key)
+			if ok && entry.matchesVary(r) {
+				now := time.Now()
+				if !reqCC.noCache && entry.isFresh(now) {
+					if opts.EnableETagPair && entry.etagMatches(r) {
+						serverLogger.Info("SERVER validator matched, short-circuiting 304")
+						entry.writeNotModified(w)
+						return
+					}
+					serverLogger.Info("SERVER using cached response")
+					entry.writeTo(w, true)
+					return
+				}
+				if !reqCC.noCache && entry.withinStaleWhileRevalidate(now) {
+					serverLogger.Info("SERVER serving stale response, revalidating in background")
+					revalidateHandlerInBackground(&sf, key, r, reqHeader, opts, storage, next)
+					entry.writeTo(w, true)
+					return
+				}
+				addConditionalHeaders(r, entry)
+			} else {
+				ok = false
+			}
+
+			buffered := newBufferingResponseWriter()
+			next(buffered, r)
+
+			if ok && buffered.statusCode == http.StatusNotModified {
+				refreshed := refreshEntry(entry, buffered.header)
+				storage.Set(key, refreshed)
+				refreshed.writeTo(w, true)
+				return
+			}
+
+			if ok && buffered.statusCode >= http.StatusInternalServerError && entry.withinStaleIfError(time.Now()) {
+				serverLogger.Warn("SERVER handler error, serving stale response")
+				w.Header().Set("X-Cache-Stale", "true")
+				entry.writeTo(w, true)
+				return
+			}
+
+			body := buffered.buffer.Bytes()
+			respCC := parseCacheControl(buffered.header.Get("Cache-Control"))
+			if buffered.statusCode == http.StatusOK && !respCC.noStore && !respCC.private {
+				if opts.EnableETagPair {
+					synthesizeValidator(buffered.header, body)
+				}
+				storage.Set(key, newCacheEntry(buffered.statusCode, buffered.header, body, reqHeader))
+			}
+
+			for field, values := range buffered.header {
+				for _, value := range values {
+					w.Header().Add(field, value)
+				}
+			}
+			w.WriteHeader(buffered.statusCode)
+			w.Write(body)
+		}
+	}
+}
+
+// CacheRoundTripper is the client-side counterpart of CacheMiddleware: it honors
+// the same freshness and Vary rules against an upstream server, issuing a
+// conditional request to revalidate a stale entry instead of always refetching the
+// full response.
+func CacheRoundTripper(next http.RoundTripper) http.RoundTripper {
+	return NewCacheRoundTripper(next, NewMapStorage(), CacheOptions{})
+}
+
+// NewCacheRoundTripper builds a CacheRoundTripper backed by a custom Storage and
+// configured by opts.
+func NewCacheRoundTripper(next http.RoundTripper, storage Storage, opts CacheOptions) http.RoundTripper {
+	var sf singleflight.Group
+
+	return RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		if !opts.cacheable(r.Method) {
+			return next.RoundTrip(r)
+		}
+
+		reqCC := parseCacheControl(r.Header.Get("Cache-Control"))
+		if reqCC.noStore {
+			// A request's own no-store means the cache must play no part at
+			// all: neither serve a stored response nor store this one.
+			return next.RoundTrip(r)
+		}
+
+		reqHeader := r.Header.Clone()
+		key := opts.cacheKey(r)
+
+		entry, ok := storage.Get(key)
+		if ok && entry.matchesVary(r) {
+			now := time.Now()
+			if !reqCC.noCache && entry.isFresh(now) {
+				clientLogger.Info("CLIENT using cached response")
+				return entry.response(true), nil
+			}
+			if !reqCC.noCache && entry.withinStaleWhileRevalidate(now) {
+				clientLogger.Info("CLIENT serving stale response, revalidating in background")
+				revalidateUpstreamInBackground(&sf, key, r, next, storage)
+				return entry.response(true), nil
+			}
+			addConditionalHeaders(r, entry)
+		} else {
+			ok = false
+		}
+
+		resp, err := next.RoundTrip(r)
+		if err != nil {
+			if ok && entry.withinStaleIfError(time.Now()) {
+				clientLogger.Warn("CLIENT request failed, serving stale response", "err", err)
+				stale := entry.response(true)
+				stale.Header.Set("X-Cache-Stale", "true")
+				return stale, nil
+			}
+			return nil, err
+		}
+
+		if ok && resp.StatusCode == http.StatusNotModified {
+			resp.Body.Close()
+			refreshed := refreshEntry(entry, resp.Header)
+			storage.Set(key, refreshed)
+			return refreshed.response(true), nil
+		}
+
+		if ok && resp.StatusCode >= http.StatusInternalServerError && entry.withinStaleIfError(time.Now()) {
+			resp.Body.Close()
+			clientLogger.Warn("CLIENT upstream error, serving stale response", "status", resp.StatusCode)
+			stale := entry.response(true)
+			stale.Header.Set("X-Cache-Stale", "true")
+			return stale, nil
+		}
+
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+
+		respCC := parseCacheControl(resp.Header.Get("Cache-Control"))
+		if resp.StatusCode == http.StatusOK && !respCC.noStore && !respCC.private {
+			storage.Set(key, newCacheEntry(resp.StatusCode, resp.Header, body, reqHeader))
+		}
+
+		return resp, nil
+	})
+}
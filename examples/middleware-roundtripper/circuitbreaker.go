@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// CBConfig configures a circuit breaker's trip and recovery behavior.
+type CBConfig struct {
+	// WindowSize is how many recent outcomes are considered when computing the
+	// rolling error ratio.
+	WindowSize int
+	// ErrorThreshold trips the breaker once the rolling error ratio over the last
+	// WindowSize requests exceeds this value.
+	ErrorThreshold float64
+	// CooldownPeriod is how long the breaker stays open before admitting a single
+	// half-open probe request.
+	CooldownPeriod time.Duration
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitBreaker implements the standard closed/open/half-open state machine: it
+// trips from closed to open when the rolling error ratio crosses ErrorThreshold,
+// stays open for CooldownPeriod, then admits exactly one half-open probe before
+// closing (on success) or reopening (on failure).
+type circuitBreaker struct {
+	cfg CBConfig
+
+	mu               sync.Mutex
+	state            circuitState
+	outcomes         []bool // ring of recent outcomes, true = success
+	openedAt         time.Time
+	halfOpenInFlight bool
+}
+
+func newCircuitBreaker(cfg CBConfig) *circuitBreaker {
+	return &circuitBreaker{cfg: cfg}
+}
+
+// allow reports whether a request may proceed, transitioning open -> half-open once
+// the cooldown has elapsed.
+func (cb *circuitBreaker) allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case circuitOpen:
+		if time.Since(cb.openedAt) < cb.cfg.CooldownPeriod {
+			return false
+		}
+		cb.state = circuitHalfOpen
+		cb.halfOpenInFlight = true
+		return true
+	case circuitHalfOpen:
+		// Only one probe is admitted at a time; concurrent callers are rejected
+		// until it resolves.
+		return false
+	default:
+		return true
+	}
+}
+
+// record reports the outcome of a request that allow() admitted.
+func (cb *circuitBreaker) record(success bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == circuitHalfOpen {
+		cb.halfOpenInFlight = false
+		if success {
+			cb.state = circuitClosed
+			cb.outcomes = nil
+		} else {
+			cb.state = circuitOpen
+			cb.openedAt = time.Now()
+		}
+		return
+	}
+
+	cb.outcomes = append(cb.outcomes, success)
+	if len(cb.outcomes) > cb.cfg.WindowSize {
+		cb.outcomes = cb.outcomes[len(cb.outcomes)-cb.cfg.WindowSize:]
+	}
+	if len(cb.outcomes) < cb.cfg.WindowSize {
+		return
+	}
+
+	errors := 0
+	for _, ok := range cb.outcomes {
+		if !ok {
+			errors++
+		}
+	}
+	if float64(errors)/float64(len(cb.outcomes)) > cb.cfg.ErrorThreshold {
+		cb.state = circuitOpen
+		cb.openedAt = time.Now()
+	}
+}
+
+// CircuitBreakerRoundTripper stops sending requests to a failing upstream once its
+// rolling error ratio trips the breaker, failing fast instead of piling up timeouts.
+func CircuitBreakerRoundTripper(next http.RoundTripper, cfg CBConfig) http.RoundTripper {
+	cb := newCircuitBreaker(cfg)
+
+	return RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		if !cb.allow() {
+			return nil, fmt.Errorf("circuit breaker open for %s", r.URL.Host)
+		}
+
+		resp, err := next.RoundTrip(r)
+		cb.record(err == nil && resp.StatusCode < http.StatusInternalServerError)
+		return resp, err
+	})
+}
+
+// CircuitBreakerMiddleware stops invoking a failing handler once its rolling error
+// ratio trips the breaker, so a struggling dependency can recover instead of being
+// buried under retries.
+func CircuitBreakerMiddleware(cfg CBConfig) func(http.HandlerFunc) http.HandlerFunc {
+	cb := newCircuitBreaker(cfg)
+
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if !cb.allow() {
+				serverLogger.Warn("SERVER circuit breaker open")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				fmt.Fprintln(w, "Service Unavailable")
+				return
+			}
+
+			writer := &responseWriter{ResponseWriter: w, buffer: &bytes.Buffer{}, statusCode: http.StatusOK}
+			next(writer, r)
+			cb.record(writer.statusCode < http.StatusInternalServerError)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// InFlightStats exposes Prometheus-style counters for MaxInFlightMiddleware, so
+// operators can watch accepted/rejected/in-flight counts over time and tune
+// limit accordingly.
+type InFlightStats struct {
+	Accepted atomic.Int64
+	Rejected atomic.Int64
+	InFlight atomic.Int64
+}
+
+// inFlightLimiter bounds concurrency with a buffered channel used as a
+// semaphore, so acquiring beyond its capacity fails fast instead of blocking.
+type inFlightLimiter struct {
+	sem chan struct{}
+	InFlightStats
+}
+
+func newInFlightLimiter(limit int) *inFlightLimiter {
+	return &inFlightLimiter{sem: make(chan struct{}, limit)}
+}
+
+func (l *inFlightLimiter) acquire() bool {
+	select {
+	case l.sem <- struct{}{}:
+		l.Accepted.Add(1)
+		l.InFlight.Add(1)
+		return true
+	default:
+		l.Rejected.Add(1)
+		return false
+	}
+}
+
+func (l *inFlightLimiter) release() {
+	l.InFlight.Add(-1)
+	<-l.sem
+}
+
+// MaxInFlightMiddleware caps the number of simultaneously processed
+// non-long-running requests at limit, rejecting with 503 and a Retry-After
+// header once that many are already in flight. Requests matching longRunning
+// (e.g. /watch, SSE, websockets) bypass the counter entirely so a handful of
+// long-lived connections can't starve the pool for everyone else.
+func MaxInFlightMiddleware(limit int, longRunning func(*http.Request) bool) func(http.HandlerFunc) http.HandlerFunc {
+	mw, _ := NewMaxInFlightMiddleware(limit, longRunning)
+	return mw
+}
+
+// NewMaxInFlightMiddleware builds the same middleware as MaxInFlightMiddleware,
+// and additionally returns the InFlightStats backing the limiter's accepted,
+// rejected, and in-flight counters.
+func NewMaxInFlightMiddleware(limit int, longRunning func(*http.Request) bool) (func(http.HandlerFunc) http.HandlerFunc, *InFlightStats) {
+	limiter := newInFlightLimiter(limit)
+
+	mw := func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if longRunning != nil && longRunning(r) {
+				next(w, r)
+				return
+			}
+
+			if !limiter.acquire() {
+				serverLogger.Warn("SERVER max in-flight requests exceeded")
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				fmt.Fprintln(w, "Service Unavailable")
+				return
+			}
+			defer limiter.release()
+
+			next(w, r)
+		}
+	}
+
+	return mw, &limiter.InFlightStats
+}
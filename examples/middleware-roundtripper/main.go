@@ -25,6 +25,31 @@ func main() {
 	// Bad: logs the password
 	// handler := Logger(Authenticator(Recovery(helloHandler)))
 
+	// Rate limiting and circuit breaking are both about protecting capacity rather
+	// than correctness, so they sit outermost, before auth and cache are even
+	// considered:
+	//   RecoveryMiddleware -> RateLimitMiddleware -> CircuitBreakerMiddleware -> AuthMiddleware -> LoggerMiddleware -> CacheMiddleware
+	// Rejecting an over-limit or already-failing caller before AuthMiddleware avoids
+	// wasting an auth check (and logging an attempt) on a request that was never
+	// going to be served. Putting the breaker after the limiter means requests the
+	// limiter rejects never reach the breaker, so they don't take up slots in its
+	// rolling window.
+
+	// SessionMiddleware must run before CSRFMiddleware: CSRF protection only makes
+	// sense once a session exists to protect, and CSRFMiddleware needs the response
+	// to still be open so it can set its cookie alongside the session cookie.
+	// CSRFMiddleware itself must run before any handler that mutates state, but
+	// after auth has established who the caller is:
+	//   RecoveryMiddleware -> AuthMiddleware -> SessionMiddleware -> CSRFMiddleware -> LoggerMiddleware -> CacheMiddleware
+
+	// MaxInFlightMiddleware belongs right after RecoveryMiddleware and before
+	// AuthMiddleware: a caller that's merely one too many concurrent requests
+	// shouldn't pay for an auth check it's about to be rejected anyway, and
+	// RecoveryMiddleware still wraps it so a panicking handler becomes a 500
+	// response (MaxInFlightMiddleware's deferred release frees the semaphore slot
+	// either way):
+	//   RecoveryMiddleware -> MaxInFlightMiddleware -> AuthMiddleware -> LoggerMiddleware -> CacheMiddleware
+
 	http.HandleFunc("GET /hello", handler)
 
 	go func() {
@@ -71,29 +96,6 @@ func (w *responseWriter) WriteHeader(code int) {
 	w.ResponseWriter.WriteHeader(code)
 }
 
-func CacheMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	cache := map[string][]byte{}
-
-	return func(w http.ResponseWriter, r *http.Request) {
-		cacheKey := fmt.Sprintf("%s_%s", r.Method, r.URL.String())
-
-		if cached, ok := cache[cacheKey]; ok {
-			serverLogger.Info("SERVER using cached response")
-			w.Header().Add("X-Server-Cached", "true")
-			w.Write(cached)
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-
-		var buf bytes.Buffer
-		writer := &responseWriter{ResponseWriter: w, buffer: &buf}
-
-		next(writer, r)
-
-		cache[cacheKey] = buf.Bytes()
-	}
-}
-
 func LoggerMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
@@ -107,6 +109,10 @@ func LoggerMiddleware(next http.HandlerFunc) http.HandlerFunc {
 
 func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		// The response depends on this request's Authorization header, so any cache
+		// sitting in front of (or behind) this middleware must key on it too.
+		w.Header().Add("Vary", "Authorization")
+
 		auth := r.Header.Get("Authorization")
 
 		if auth != "password" {
@@ -146,6 +152,7 @@ func SequentialMiddleware(middleware ...func(http.HandlerFunc) http.HandlerFunc)
 
 func helloHandler(w http.ResponseWriter, r *http.Request) {
 	// panic("Something went wrong!")
+	w.Header().Set("Cache-Control", "max-age=60")
 	fmt.Fprintln(w, "Hello, World!")
 	w.WriteHeader(http.StatusOK)
 }
@@ -196,55 +203,6 @@ func AuthRoundTripper(next http.RoundTripper) http.RoundTripper {
 	})
 }
 
-type cachedResponse struct {
-	resp http.Response
-	body []byte
-}
-
-func newCachedResponse(resp *http.Response) cachedResponse {
-	cachedResp := cachedResponse{
-		resp: *resp,
-	}
-
-	bodyBytes, _ := io.ReadAll(resp.Body)
-	cachedResp.body = bodyBytes
-
-	resp.Body = io.NopCloser(bytes.NewReader(bodyBytes))
-
-	return cachedResp
-}
-
-func (cr cachedResponse) Response() *http.Response {
-	cr.resp.Body = io.NopCloser(bytes.NewReader(cr.body))
-	cr.resp.ContentLength = int64(len(cr.body))
-	cr.resp.Header.Add("X-Client-Cached", "true")
-	return &cr.resp
-}
-
-func CacheRoundTripper(next http.RoundTripper) http.RoundTripper {
-	cache := map[string]cachedResponse{}
-
-	return RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
-		cacheKey := fmt.Sprintf("%s_%s", r.Method, r.URL.String())
-
-		// Detect password for demo
-		password := r.Header.Get("Authorization")
-		if password != "" {
-			clientLogger.Warn("are you sure that you want to cache the password?", "password", password)
-		}
-
-		cachedResponse, ok := cache[cacheKey]
-		if ok {
-			clientLogger.Info("CLIENT using cached response")
-			return cachedResponse.Response(), nil
-		}
-
-		resp, err := next.RoundTrip(r)
-		cache[cacheKey] = newCachedResponse(resp)
-		return resp, err
-	})
-}
-
 func NewClientWithRoundTrippers(rts ...func(http.RoundTripper) http.RoundTripper) *http.Client {
 	return &http.Client{
 		Transport: SequentialRoundTripper(rts...),
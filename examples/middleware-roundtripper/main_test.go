@@ -2,11 +2,17 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
+	"net/http/cookiejar"
 	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestGood(t *testing.T) {
@@ -85,9 +91,12 @@ func TestGood(t *testing.T) {
 	})
 }
 
-func TestBad_ServerCacheExposesAccess(t *testing.T) {
-	// The server will cache responses before checking authentication. After caching a response, the next request
-	// will receive this response even if it does not authenticate successfully
+func TestGood_VaryPreventsServerCacheLeak(t *testing.T) {
+	// The server still caches responses before checking authentication, but
+	// AuthMiddleware sets "Vary: Authorization" on every response, so CacheMiddleware
+	// only serves a cached entry to a request presenting the same Authorization
+	// value that produced it. What used to be an exploitable footgun is now a
+	// demonstrated safeguard.
 	handler := SequentialMiddleware(
 		CacheMiddleware,
 		LoggerMiddleware,
@@ -114,8 +123,10 @@ func TestBad_ServerCacheExposesAccess(t *testing.T) {
 		}.assert(t, body, resp)
 	})
 
-	// Server cache is used before AuthMiddleware, allowing unrestricted access
-	t.Run("RequestWithoutAuth", func(t *testing.T) {
+	// The cached entry's Vary-captured Authorization value doesn't match an empty
+	// one, so this still reaches AuthMiddleware and is rejected instead of reusing
+	// the authenticated response.
+	t.Run("RequestWithoutAuthIsNotServedFromCache", func(t *testing.T) {
 		client := NewClientWithRoundTrippers(
 			LogRoundTripper,
 		)
@@ -125,13 +136,606 @@ func TestBad_ServerCacheExposesAccess(t *testing.T) {
 			t.Errorf("unexpected error: %v", err)
 		}
 		expectations{
-			StatusCode:      http.StatusOK,
-			Body:            "Hello, World!\n",
-			ServerCacheUsed: true,
+			StatusCode: http.StatusForbidden,
+			Body:       "Forbidden\n",
 		}.assert(t, body, resp)
 	})
 }
 
+func TestCacheMiddleware_CachesPOSTByBodyHash(t *testing.T) {
+	var calls int
+	searchHandler := func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprintf(w, "results for: %s", body)
+	}
+
+	handler := NewCacheMiddleware(NewMapStorage(), CacheOptions{
+		CacheableMethods: []string{http.MethodPost},
+		CacheKey:         HashBodyCacheKey,
+	})(searchHandler)
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	post := func(body string) (string, *http.Response) {
+		resp, err := http.Post(server.URL, "text/plain", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return string(b), resp
+	}
+
+	body1, resp1 := post("flour")
+	if resp1.Header.Get("X-Server-Cached") != "" {
+		t.Errorf("first request should not be cached")
+	}
+
+	body2, resp2 := post("flour")
+	if resp2.Header.Get("X-Server-Cached") != "true" {
+		t.Errorf("repeat request with the same body should be served from cache")
+	}
+	if body2 != body1 {
+		t.Errorf("cached response body changed: %q != %q", body2, body1)
+	}
+
+	body3, resp3 := post("water")
+	if resp3.Header.Get("X-Server-Cached") != "" {
+		t.Errorf("a different body should miss the cache")
+	}
+	if body3 == body1 {
+		t.Errorf("different bodies should produce different responses")
+	}
+
+	if calls != 2 {
+		t.Errorf("expected the handler to run once per distinct body, ran %d times", calls)
+	}
+}
+
+func TestCacheMiddleware_ETagPairShortCircuits304(t *testing.T) {
+	var calls int
+	handler := NewCacheMiddleware(NewMapStorage(), CacheOptions{EnableETagPair: true})(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprintln(w, "Hello, World!")
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	get := func(etag string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, server.URL, http.NoBody)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp1 := get("")
+	body1, _ := io.ReadAll(resp1.Body)
+	resp1.Body.Close()
+	if resp1.StatusCode != http.StatusOK || len(body1) == 0 {
+		t.Fatalf("expected a full response, got %d with body %q", resp1.StatusCode, body1)
+	}
+	etag := resp1.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("expected a synthesized ETag")
+	}
+
+	// The entry is still fresh (max-age=60), so a matching validator short-circuits
+	// to a bare 304 without invoking the handler again.
+	resp2 := get(etag)
+	body2, _ := io.ReadAll(resp2.Body)
+	resp2.Body.Close()
+	if resp2.StatusCode != http.StatusNotModified {
+		t.Errorf("expected 304, got %d", resp2.StatusCode)
+	}
+	if len(body2) != 0 {
+		t.Errorf("expected no body on a 304, got %d bytes", len(body2))
+	}
+	if resp2.Header.Get("X-Server-Cached") != "true" {
+		t.Errorf("expected X-Server-Cached to reflect the cached hit")
+	}
+	if calls != 1 {
+		t.Errorf("expected the handler to run once, ran %d times: a fresh matching validator should short-circuit the second request", calls)
+	}
+}
+
+func TestCacheMiddleware_ETagPairDoesNotShortCircuitStaleEntry(t *testing.T) {
+	var calls int
+	handler := NewCacheMiddleware(NewMapStorage(), CacheOptions{EnableETagPair: true})(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Cache-Control", "no-cache") // force revalidation against the origin on every use
+		fmt.Fprintln(w, "Hello, World!")
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	get := func(etag string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, server.URL, http.NoBody)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp1 := get("")
+	body1, _ := io.ReadAll(resp1.Body)
+	resp1.Body.Close()
+	if resp1.StatusCode != http.StatusOK || len(body1) == 0 {
+		t.Fatalf("expected a full response, got %d with body %q", resp1.StatusCode, body1)
+	}
+	etag := resp1.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("expected a synthesized ETag")
+	}
+
+	// no-cache means the entry is never fresh, so even a client presenting the
+	// matching validator must be routed back to the handler instead of getting a
+	// bare 304 from the cache's own record.
+	resp2 := get(etag)
+	io.ReadAll(resp2.Body)
+	resp2.Body.Close()
+	if resp2.StatusCode != http.StatusOK {
+		t.Errorf("expected a full re-fetch, got %d", resp2.StatusCode)
+	}
+	if calls != 2 {
+		t.Errorf("expected the handler to run again for a no-cache entry, ran %d times", calls)
+	}
+}
+
+func TestMaxInFlightMiddleware_RejectsOneOverLimit(t *testing.T) {
+	const limit = 3
+
+	release := make(chan struct{})
+	inHandler := make(chan struct{}, limit)
+	blockingHandler := func(w http.ResponseWriter, r *http.Request) {
+		inHandler <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}
+
+	mw, stats := NewMaxInFlightMiddleware(limit, func(r *http.Request) bool {
+		return r.URL.Path == "/watch"
+	})
+	handler := SequentialMiddleware(mw)(blockingHandler)
+
+	req, _ := http.NewRequest(http.MethodGet, "/", http.NoBody)
+
+	results := make(chan int, limit)
+	for i := 0; i < limit; i++ {
+		go func() {
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			results <- rec.Code
+		}()
+	}
+
+	// Wait for exactly `limit` requests to reach the handler before calling it
+	// directly for the (limit+1)th, ourselves, in this goroutine: with no dial or
+	// goroutine scheduling between "slot full" and "next acquire", it's
+	// guaranteed to find the semaphore full rather than racing a freed slot.
+	for i := 0; i < limit; i++ {
+		<-inHandler
+	}
+
+	rejectedRec := httptest.NewRecorder()
+	handler(rejectedRec, req)
+	if rejectedRec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected the request over the limit to be rejected, got %d", rejectedRec.Code)
+	}
+
+	close(release)
+
+	var ok int
+	for i := 0; i < limit; i++ {
+		if code := <-results; code == http.StatusOK {
+			ok++
+		}
+	}
+	if ok != limit {
+		t.Errorf("expected %d accepted, got %d", limit, ok)
+	}
+	if stats.Accepted.Load() != int64(limit) || stats.Rejected.Load() != 1 {
+		t.Errorf("stats mismatch: accepted=%d rejected=%d", stats.Accepted.Load(), stats.Rejected.Load())
+	}
+}
+
+func TestMaxInFlightMiddleware_LongRunningBypassesLimit(t *testing.T) {
+	mw, stats := NewMaxInFlightMiddleware(1, func(r *http.Request) bool {
+		return r.URL.Path == "/watch"
+	})
+	handler := SequentialMiddleware(mw)(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	for i := 0; i < 5; i++ {
+		resp, err := http.Get(server.URL + "/watch")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected /watch to bypass the limiter, got %d", resp.StatusCode)
+		}
+	}
+
+	if stats.Accepted.Load() != 0 || stats.Rejected.Load() != 0 {
+		t.Errorf("expected long-running requests not to touch the counters, got accepted=%d rejected=%d", stats.Accepted.Load(), stats.Rejected.Load())
+	}
+}
+
+func TestCacheRoundTripper_StaleWhileRevalidateDedupsBackgroundFetch(t *testing.T) {
+	var calls atomic.Int64
+	slow := make(chan struct{})
+
+	upstream := RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		n := calls.Add(1)
+		body := "v1"
+		if n > 1 {
+			<-slow // simulate a slow upstream for the background revalidation
+			body = "v2"
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Cache-Control": {"max-age=0, stale-while-revalidate=30"}},
+			Body:       io.NopCloser(strings.NewReader(body)),
+		}, nil
+	})
+
+	client := &http.Client{Transport: CacheRoundTripper(upstream)}
+
+	// max-age=0 means this entry is stale the instant it's stored.
+	resp, err := client.Get("http://example.test/resource")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "v1" {
+		t.Fatalf("unexpected body: %q", body)
+	}
+
+	const concurrent = 5
+	results := make(chan string, concurrent)
+	start := time.Now()
+	for i := 0; i < concurrent; i++ {
+		go func() {
+			resp, err := client.Get("http://example.test/resource")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			results <- string(body)
+		}()
+	}
+
+	for i := 0; i < concurrent; i++ {
+		if got := <-results; got != "v1" {
+			t.Errorf("expected the stale body to be served while revalidating, got %q", got)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 20*time.Millisecond {
+		t.Errorf("stale hits should return immediately without waiting on the slow upstream, took %s", elapsed)
+	}
+
+	close(slow)
+	deadline := time.Now().Add(time.Second)
+	for calls.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(5 * time.Millisecond) // give the single background fetch a moment to finish storing
+
+	if calls.Load() != 2 {
+		t.Errorf("expected exactly one background revalidation despite %d concurrent stale hits, got %d extra upstream calls", concurrent, calls.Load()-1)
+	}
+}
+
+func TestCacheMiddleware_StaleIfErrorFallsBackOnUpstreamError(t *testing.T) {
+	var fail atomic.Bool
+	handler := NewCacheMiddleware(NewMapStorage(), CacheOptions{})(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=0, stale-if-error=30")
+		fmt.Fprintln(w, "Hello, World!")
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "Hello, World!\n" {
+		t.Fatalf("unexpected body: %q", body)
+	}
+
+	fail.Store(true)
+
+	resp2, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body2, _ := io.ReadAll(resp2.Body)
+	resp2.Body.Close()
+
+	if resp2.StatusCode != http.StatusOK {
+		t.Errorf("expected the stale response to mask the upstream error, got %d", resp2.StatusCode)
+	}
+	if string(body2) != string(body) {
+		t.Errorf("expected the stale body to be served, got %q", body2)
+	}
+	if resp2.Header.Get("X-Cache-Stale") != "true" {
+		t.Errorf("expected X-Cache-Stale to reflect the fallback")
+	}
+}
+
+func TestCacheMiddleware_MustRevalidateSuppressesStaleIfError(t *testing.T) {
+	var fail atomic.Bool
+	handler := NewCacheMiddleware(NewMapStorage(), CacheOptions{})(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=0, must-revalidate, stale-if-error=30")
+		fmt.Fprintln(w, "Hello, World!")
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	fail.Store(true)
+
+	resp2, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(resp2.Body)
+	resp2.Body.Close()
+
+	if resp2.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected must-revalidate to suppress the stale-if-error fallback, got %d", resp2.StatusCode)
+	}
+}
+
+func TestCacheMiddleware_RequestNoCacheForcesRevalidation(t *testing.T) {
+	var calls int
+	handler := NewCacheMiddleware(NewMapStorage(), CacheOptions{})(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprintln(w, "Hello, World!")
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	get := func(noCache bool) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, server.URL, http.NoBody)
+		if noCache {
+			req.Header.Set("Cache-Control", "no-cache")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp1 := get(false)
+	io.ReadAll(resp1.Body)
+	resp1.Body.Close()
+	if resp1.Header.Get("X-Server-Cached") != "" {
+		t.Fatalf("first request should not be cached")
+	}
+
+	// Still well within max-age=60, so without the request's own no-cache this
+	// would be served straight from the cache.
+	resp2 := get(true)
+	io.ReadAll(resp2.Body)
+	resp2.Body.Close()
+	if resp2.Header.Get("X-Server-Cached") == "true" {
+		t.Errorf("expected a request Cache-Control: no-cache to force revalidation, got a cache hit")
+	}
+	if calls != 2 {
+		t.Errorf("expected the handler to run again for a no-cache request, ran %d times", calls)
+	}
+}
+
+func TestCacheMiddleware_RequestNoStoreBypassesCache(t *testing.T) {
+	var calls int
+	handler := NewCacheMiddleware(NewMapStorage(), CacheOptions{})(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprintln(w, "Hello, World!")
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL, http.NoBody)
+	req.Header.Set("Cache-Control", "no-store")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	resp2, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(resp2.Body)
+	resp2.Body.Close()
+
+	if resp2.Header.Get("X-Server-Cached") == "true" {
+		t.Errorf("a no-store request should never populate the cache")
+	}
+	if calls != 2 {
+		t.Errorf("expected both requests to reach the handler, ran %d times", calls)
+	}
+}
+
+func TestCircuitBreaker_ClosedOpenHalfOpenClosed(t *testing.T) {
+	cb := newCircuitBreaker(CBConfig{WindowSize: 2, ErrorThreshold: 0.5, CooldownPeriod: 20 * time.Millisecond})
+
+	cb.allow()
+	cb.record(true)
+	if cb.state != circuitClosed {
+		t.Fatalf("expected breaker to remain closed after a success, got %d", cb.state)
+	}
+
+	// A single failure in a window of 2 sits right at the 0.5 threshold, which
+	// isn't enough to trip: the ratio must exceed, not just meet, it.
+	cb.allow()
+	cb.record(false)
+	if cb.state != circuitClosed {
+		t.Fatalf("expected breaker to remain closed at the threshold boundary, got %d", cb.state)
+	}
+
+	// A second consecutive failure pushes the rolling ratio to 1.0, tripping it.
+	cb.allow()
+	cb.record(false)
+	if cb.state != circuitOpen {
+		t.Fatalf("expected breaker to trip open once the error ratio exceeds the threshold, got %d", cb.state)
+	}
+
+	if cb.allow() {
+		t.Fatal("expected the breaker to reject while cooling down")
+	}
+
+	time.Sleep(25 * time.Millisecond)
+
+	if !cb.allow() {
+		t.Fatal("expected the elapsed cooldown to admit a half-open probe")
+	}
+	if cb.state != circuitHalfOpen {
+		t.Fatalf("expected half-open state, got %d", cb.state)
+	}
+	if cb.allow() {
+		t.Fatal("expected a second concurrent probe to be rejected while one is in flight")
+	}
+
+	cb.record(true)
+	if cb.state != circuitClosed {
+		t.Fatalf("expected a successful probe to close the breaker, got %d", cb.state)
+	}
+	if len(cb.outcomes) != 0 {
+		t.Errorf("expected outcomes to reset after closing, got %v", cb.outcomes)
+	}
+}
+
+func TestCircuitBreaker_HalfOpenProbeFailureReopens(t *testing.T) {
+	cb := newCircuitBreaker(CBConfig{WindowSize: 1, ErrorThreshold: 0.5, CooldownPeriod: time.Millisecond})
+
+	cb.allow()
+	cb.record(false)
+	if cb.state != circuitOpen {
+		t.Fatalf("expected breaker to trip open, got %d", cb.state)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	if !cb.allow() {
+		t.Fatal("expected the elapsed cooldown to admit a half-open probe")
+	}
+	cb.record(false)
+	if cb.state != circuitOpen {
+		t.Fatalf("expected a failed probe to reopen the breaker, got %d", cb.state)
+	}
+}
+
+func TestCSRFMiddleware_AcceptsMatchingTokenRejectsMismatch(t *testing.T) {
+	handler := CSRFMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Jar: jar}
+
+	// A safe method is let through without a token, and issues the CSRF cookie.
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected a safe method through without a token, got %d", resp.StatusCode)
+	}
+
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var token string
+	for _, c := range jar.Cookies(serverURL) {
+		if c.Name == csrfCookieName {
+			token = c.Value
+		}
+	}
+	if token == "" {
+		t.Fatal("expected a csrf_token cookie to be issued")
+	}
+
+	post := func(headerToken string) *http.Response {
+		req, _ := http.NewRequest(http.MethodPost, server.URL, http.NoBody)
+		if headerToken != "" {
+			req.Header.Set(csrfHeaderName, headerToken)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	if resp := post(token); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected a matching double-submit token to be accepted, got %d", resp.StatusCode)
+	}
+	if resp := post("wrong-token"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected a mismatched token to be rejected, got %d", resp.StatusCode)
+	}
+	if resp := post(""); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected a missing token to be rejected, got %d", resp.StatusCode)
+	}
+}
+
 type TestLogHandler struct {
 	slog.Handler
 	records []slog.Record
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimitRoundTripper throttles outgoing requests per destination host using a
+// token bucket, so a client can't accidentally hammer an upstream even if callers
+// queue up requests faster than it can send them.
+func RateLimitRoundTripper(next http.RoundTripper, r rate.Limit, burst int) http.RoundTripper {
+	limiters := perHostLimiters{limit: r, burst: burst, limiters: map[string]*rate.Limiter{}}
+
+	return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if err := limiters.forHost(req.URL.Host).Wait(req.Context()); err != nil {
+			return nil, fmt.Errorf("rate limit: %w", err)
+		}
+		return next.RoundTrip(req)
+	})
+}
+
+// RateLimitMiddleware throttles incoming requests per caller using a token bucket,
+// rejecting with 429 and a Retry-After header once a caller exceeds its burst.
+func RateLimitMiddleware(limit rate.Limit, burst int) func(http.HandlerFunc) http.HandlerFunc {
+	limiters := perHostLimiters{limit: limit, burst: burst, limiters: map[string]*rate.Limiter{}}
+
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			host, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				host = r.RemoteAddr
+			}
+			if !limiters.forHost(host).Allow() {
+				serverLogger.Warn("SERVER rate limit exceeded", "caller", r.RemoteAddr)
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusTooManyRequests)
+				fmt.Fprintln(w, "Too Many Requests")
+				return
+			}
+			next(w, r)
+		}
+	}
+}
+
+// perHostLimiters keys a token bucket by host so one noisy destination (client side)
+// or caller (server side) can't exhaust the budget of every other one.
+type perHostLimiters struct {
+	limit rate.Limit
+	burst int
+
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+func (p *perHostLimiters) forHost(host string) *rate.Limiter {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	limiter, ok := p.limiters[host]
+	if !ok {
+		limiter = rate.NewLimiter(p.limit, p.burst)
+		p.limiters[host] = limiter
+	}
+	return limiter
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"golang.org/x/crypto/nacl/secretbox"
+
+	"middleware-roundtripper/session"
+)
+
+// CookieKeySet is a rotating set of secretbox keys: Primary seals new cookies;
+// Fallback, if set, is still accepted when opening so existing cookies keep
+// working across a key rotation instead of forcing every session to restart.
+type CookieKeySet struct {
+	Primary  [32]byte
+	Fallback *[32]byte
+}
+
+func sealCookieValue(keys CookieKeySet, value string) (string, error) {
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return "", fmt.Errorf("generating nonce: %w", err)
+	}
+
+	sealed := secretbox.Seal(nonce[:], []byte(value), &nonce, &keys.Primary)
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func openCookieValue(keys CookieKeySet, sealed string) (string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil || len(raw) < 24 {
+		return "", fmt.Errorf("malformed cookie")
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], raw[:24])
+
+	if opened, ok := secretbox.Open(nil, raw[24:], &nonce, &keys.Primary); ok {
+		return string(opened), nil
+	}
+	if keys.Fallback != nil {
+		if opened, ok := secretbox.Open(nil, raw[24:], &nonce, keys.Fallback); ok {
+			return string(opened), nil
+		}
+	}
+
+	return "", fmt.Errorf("cookie failed authentication")
+}
+
+// SecretBoxCookieMiddleware returns seal and open functions backed by a rotating
+// secretbox key set, so cookie values are confidential and tamper-evident without
+// the server keeping any per-cookie state. SessionMiddleware uses these to protect
+// the session ID cookie.
+func SecretBoxCookieMiddleware(keys CookieKeySet) (seal func(value string) (string, error), open func(sealed string) (string, error)) {
+	return func(value string) (string, error) {
+			return sealCookieValue(keys, value)
+		}, func(sealed string) (string, error) {
+			return openCookieValue(keys, sealed)
+		}
+}
+
+const sessionCookieName = "session_id"
+
+func newRandomID() (string, error) {
+	var raw [16]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw[:]), nil
+}
+
+// SessionMiddleware assigns each caller a session ID cookie sealed by
+// SecretBoxCookieMiddleware, loads that session's Data from store, and makes it
+// available to handlers via session.FromContext. Any changes the handler makes to
+// the Data are saved back to store once it returns.
+func SessionMiddleware(store session.Store, keys CookieKeySet) func(http.HandlerFunc) http.HandlerFunc {
+	seal, open := SecretBoxCookieMiddleware(keys)
+
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			id, data := loadSession(r, store, open)
+
+			if id == "" {
+				newID, err := newRandomID()
+				if err != nil {
+					http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+					return
+				}
+				id, data = newID, session.Data{}
+
+				sealedID, err := seal(id)
+				if err != nil {
+					http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+					return
+				}
+				http.SetCookie(w, &http.Cookie{
+					Name:     sessionCookieName,
+					Value:    sealedID,
+					Path:     "/",
+					HttpOnly: true,
+					Secure:   true,
+					SameSite: http.SameSiteLaxMode,
+				})
+			}
+
+			r = r.WithContext(session.NewContext(r.Context(), data))
+			next(w, r)
+
+			if err := store.Save(id, session.FromContext(r.Context())); err != nil {
+				serverLogger.Error(fmt.Sprintf("SERVER failed to save session: %v", err))
+			}
+		}
+	}
+}
+
+func loadSession(r *http.Request, store session.Store, open func(string) (string, error)) (string, session.Data) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return "", nil
+	}
+
+	id, err := open(cookie.Value)
+	if err != nil {
+		return "", nil
+	}
+
+	data, ok := store.Load(id)
+	if !ok {
+		return "", nil
+	}
+	return id, data
+}
+
+// SafeMethods are the HTTP methods CSRFMiddleware allows through without a matching
+// token, since they must not have side effects.
+var SafeMethods = []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+
+const (
+	csrfCookieName = "csrf_token"
+	csrfHeaderName = "X-CSRF-Token"
+)
+
+// CSRFMiddleware issues a double-submit CSRF token cookie and validates it against
+// the X-CSRF-Token header on any request whose method isn't in SafeMethods. A
+// cross-site request can trigger the browser to send the cookie but can't read its
+// value to echo back in the header, so the comparison fails.
+func CSRFMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(csrfCookieName)
+		if err != nil {
+			token, genErr := newRandomID()
+			if genErr != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			cookie = &http.Cookie{Name: csrfCookieName, Value: token, Path: "/", SameSite: http.SameSiteLaxMode}
+			http.SetCookie(w, cookie)
+		}
+
+		if !slices.Contains(SafeMethods, r.Method) {
+			header := r.Header.Get(csrfHeaderName)
+			if header == "" || subtle.ConstantTimeCompare([]byte(header), []byte(cookie.Value)) != 1 {
+				serverLogger.Warn("SERVER CSRF token mismatch")
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprintln(w, "Forbidden")
+				return
+			}
+		}
+
+		next(w, r)
+	}
+}
@@ -0,0 +1,73 @@
+// Package session provides the per-request session state stored by
+// SessionMiddleware and retrieved by handlers via FromContext.
+package session
+
+import (
+	"context"
+	"sync"
+)
+
+// Data is the set of values associated with a session.
+type Data map[string]any
+
+// Store persists session Data by ID. MemoryStore below is the default, in-process
+// implementation; a Redis or file-backed Store needs only to implement Load, Save,
+// and Delete with the same ID-keyed shape to drop in as a replacement.
+type Store interface {
+	Load(id string) (Data, bool)
+	Save(id string, data Data) error
+	Delete(id string) error
+}
+
+// MemoryStore is a Store backed by an in-memory map. It only survives for the
+// lifetime of the process, which is fine for this demo but not for a real
+// deployment spanning multiple server instances.
+type MemoryStore struct {
+	mu   sync.Mutex
+	data map[string]Data
+}
+
+// NewMemoryStore creates an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{data: map[string]Data{}}
+}
+
+func (m *MemoryStore) Load(id string) (Data, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, ok := m.data[id]
+	return data, ok
+}
+
+func (m *MemoryStore) Save(id string, data Data) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.data[id] = data
+	return nil
+}
+
+func (m *MemoryStore) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.data, id)
+	return nil
+}
+
+type contextKey int
+
+const dataKey contextKey = 0
+
+// NewContext returns a context carrying data, for use by SessionMiddleware.
+func NewContext(ctx context.Context, data Data) context.Context {
+	return context.WithValue(ctx, dataKey, data)
+}
+
+// FromContext returns the session Data stored by SessionMiddleware, or nil if no
+// session is present on ctx.
+func FromContext(ctx context.Context) Data {
+	data, _ := ctx.Value(dataKey).(Data)
+	return data
+}